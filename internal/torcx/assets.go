@@ -0,0 +1,27 @@
+// Copyright 2021 Kinvolk GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+// retrieveAssets discovers the CNI assets shipped by an unpacked image under
+// imageRoot, for applyImage to hand off to propagateCNI. Only Assets.CNI is
+// populated; the other Assets fields are always left empty.
+func retrieveAssets(applyCfg *ApplyConfig, imageRoot string) (*Assets, error) {
+	cni, err := discoverCNIAssets(imageRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Assets{CNI: cni}, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 Kinvolk GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultCNIConfDir is where CNI network configuration files are
+	// installed, unless overridden by ApplyConfig.CNIConfPath.
+	DefaultCNIConfDir = "/etc/cni/net.d"
+	// DefaultCNIBinDir is where CNI plugin binaries are symlinked,
+	// unless overridden by ApplyConfig.CNIBinPath.
+	DefaultCNIBinDir = "/opt/cni/bin"
+)
+
+// CNIConfDir returns the directory CNI network configuration files are
+// installed to, defaulting to DefaultCNIConfDir.
+func (a *ApplyConfig) CNIConfDir() string {
+	if a.CNIConfPath != "" {
+		return a.CNIConfPath
+	}
+	return DefaultCNIConfDir
+}
+
+// CNIBinDir returns the directory CNI plugin binaries are symlinked into,
+// defaulting to DefaultCNIBinDir.
+func (a *ApplyConfig) CNIBinDir() string {
+	if a.CNIBinPath != "" {
+		return a.CNIBinPath
+	}
+	return DefaultCNIBinDir
+}
+
+// discoverCNIAssets walks an unpacked image's cni/ subtree and returns the
+// paths of any CNI assets found, relative to that subtree, for
+// retrieveAssets to populate Assets.CNI with. A missing cni/ subtree is not
+// an error: it just means the image ships no CNI assets.
+func discoverCNIAssets(imageRoot string) ([]string, error) {
+	cniRoot := filepath.Join(imageRoot, "cni")
+
+	var assets []string
+	err := filepath.Walk(cniRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(cniRoot, path)
+		if err != nil {
+			return err
+		}
+		assets = append(assets, rel)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "walking %q", cniRoot)
+	}
+
+	return assets, nil
+}
+
+// propagateCNI installs the CNI assets shipped by an image under its cni/
+// subtree: `.conflist`/`.conf` files go to CNIConfDir, and binaries under
+// cni/bin/ are symlinked into CNIBinDir. It mirrors propagateNetworkdUnits.
+//
+// assets is expected to come from discoverCNIAssets, via retrieveAssets.
+func propagateCNI(applyCfg *ApplyConfig, imageRoot string, assets []string) error {
+	if applyCfg == nil {
+		return errors.New("missing apply configuration")
+	}
+
+	confDir := applyCfg.CNIConfDir()
+	if err := os.MkdirAll(confDir, 0755); err != nil {
+		return errors.Wrapf(err, "creating %q", confDir)
+	}
+	binDir := applyCfg.CNIBinDir()
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		return errors.Wrapf(err, "creating %q", binDir)
+	}
+
+	for _, asset := range assets {
+		srcPath := filepath.Join(imageRoot, "cni", asset)
+
+		if strings.HasPrefix(asset, "bin"+string(filepath.Separator)) {
+			dstPath := filepath.Join(binDir, filepath.Base(asset))
+			if err := os.RemoveAll(dstPath); err != nil {
+				return errors.Wrapf(err, "removing stale %q", dstPath)
+			}
+			if err := os.Symlink(srcPath, dstPath); err != nil {
+				return errors.Wrapf(err, "symlinking %q to %q", dstPath, srcPath)
+			}
+			continue
+		}
+
+		switch filepath.Ext(asset) {
+		case ".conflist", ".conf":
+			dstPath := filepath.Join(confDir, filepath.Base(asset))
+			if err := copyFile(srcPath, dstPath); err != nil {
+				return errors.Wrapf(err, "installing %q", dstPath)
+			}
+		default:
+			return errors.Errorf("unrecognized CNI asset %q", asset)
+		}
+	}
+
+	return nil
+}
+
+// copyFile copies srcPath to dstPath, creating or truncating dstPath.
+func copyFile(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
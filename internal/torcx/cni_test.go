@@ -0,0 +1,77 @@
+// Copyright 2021 Kinvolk GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// TestDiscoverCNIAssets checks that discoverCNIAssets finds both plain
+// config files and binaries nested under cni/bin/, returning paths relative
+// to the cni/ subtree as propagateCNI expects.
+func TestDiscoverCNIAssets(t *testing.T) {
+	imageRoot := t.TempDir()
+	cniRoot := filepath.Join(imageRoot, "cni")
+	binDir := filepath.Join(cniRoot, "bin")
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(cniRoot, "10-flannel.conflist"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(binDir, "flannel"), []byte("fake binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	assets, err := discoverCNIAssets(imageRoot)
+	if err != nil {
+		t.Fatalf("discoverCNIAssets: %s", err)
+	}
+	sort.Strings(assets)
+
+	want := []string{
+		filepath.Join("bin", "flannel"),
+		"10-flannel.conflist",
+	}
+	sort.Strings(want)
+
+	if len(assets) != len(want) {
+		t.Fatalf("got %v, want %v", assets, want)
+	}
+	for i := range want {
+		if assets[i] != want[i] {
+			t.Errorf("got %v, want %v", assets, want)
+			break
+		}
+	}
+}
+
+// TestDiscoverCNIAssetsMissingDir checks that an image with no cni/ subtree
+// is not an error: it just ships no CNI assets.
+func TestDiscoverCNIAssetsMissingDir(t *testing.T) {
+	imageRoot := t.TempDir()
+
+	assets, err := discoverCNIAssets(imageRoot)
+	if err != nil {
+		t.Fatalf("discoverCNIAssets: %s", err)
+	}
+	if len(assets) != 0 {
+		t.Fatalf("got %v, want no assets", assets)
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2021 Kinvolk GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/pkg/errors"
+)
+
+// maxCachedChunks bounds the number of verified eStargz chunks kept in
+// memory per open file, so that reading a large addon does not grow
+// unbounded even though it is never fully unpacked.
+const maxCachedChunks = 64
+
+// mountEstargz lazily mounts an eStargz archive as a FUSE filesystem,
+// returning the mounted directory. Unlike unpackTgz, the archive's content
+// is never fully extracted: each file read pulls only the eStargz chunks it
+// touches, verifying them against the archive's table of contents.
+func mountEstargz(applyCfg *ApplyConfig, archivePath, imageName string) (string, error) {
+	if applyCfg == nil {
+		return "", errors.New("missing apply configuration")
+	}
+	if archivePath == "" || imageName == "" {
+		return "", errors.New("missing unpack source")
+	}
+
+	topDir := filepath.Join(applyCfg.RunUnpackDir(), imageName)
+	if _, err := os.Stat(topDir); err != nil && os.IsNotExist(err) {
+		if err := os.MkdirAll(topDir, 0755); err != nil {
+			return "", err
+		}
+	}
+
+	ra, size, err := estargzReaderAt(archivePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "opening %q", archivePath)
+	}
+
+	sr := io.NewSectionReader(ra, 0, size)
+	r, err := estargz.Open(sr)
+	if err != nil {
+		return "", errors.Wrapf(err, "parsing eStargz TOC in %q", archivePath)
+	}
+
+	root, ok := r.Lookup("")
+	if !ok {
+		return "", errors.Errorf("%q has no root directory entry", archivePath)
+	}
+
+	if _, err := fs.Mount(topDir, &estargzRoot{r: r, root: root}, &fs.Options{}); err != nil {
+		return "", errors.Wrapf(err, "mounting eStargz filesystem at %q", topDir)
+	}
+
+	return topDir, nil
+}
+
+// estargzReaderAt opens archivePath for ranged reads. archivePath always
+// names a local file: mountEstargz is only ever called with Archive.Filepath,
+// which every other archive format in this package also treats as a path on
+// local disk, so there is no Remote-backed ranged-HTTP archive to support
+// here.
+func estargzReaderAt(archivePath string) (io.ReaderAt, int64, error) {
+	fp, err := os.Open(archivePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	return fp, fi.Size(), nil
+}
+
+// estargzRoot is the FUSE root node for a mounted eStargz archive.
+type estargzRoot struct {
+	fs.Inode
+
+	r    *estargz.Reader
+	root *estargz.TOCEntry
+}
+
+var _ = (fs.NodeOnAdder)((*estargzRoot)(nil))
+
+// OnAdd builds the FUSE inode tree from the archive's table of contents.
+func (er *estargzRoot) OnAdd(ctx context.Context) {
+	er.addChildren(ctx, &er.Inode, "", er.root)
+}
+
+func (er *estargzRoot) addChildren(ctx context.Context, parent *fs.Inode, dir string, ent *estargz.TOCEntry) {
+	ent.ForeachChild(func(baseName string, child *estargz.TOCEntry) bool {
+		name := filepath.Join(dir, baseName)
+
+		switch child.Type {
+		case "dir":
+			childInode := parent.NewPersistentInode(ctx, &fs.Inode{}, fs.StableAttr{Mode: fuse.S_IFDIR})
+			parent.AddChild(baseName, childInode, true)
+			er.addChildren(ctx, childInode, name, child)
+		case "symlink", "hardlink":
+			childInode := parent.NewPersistentInode(ctx, &estargzLink{ent: child}, fs.StableAttr{Mode: fuse.S_IFLNK})
+			parent.AddChild(baseName, childInode, true)
+		case "reg", "chunk":
+			childInode := parent.NewPersistentInode(ctx, &estargzFile{r: er.r, name: name, ent: child}, fs.StableAttr{})
+			parent.AddChild(baseName, childInode, true)
+		}
+		return true
+	})
+}
+
+// estargzLink is a symlink or hardlink entry.
+type estargzLink struct {
+	fs.Inode
+	ent *estargz.TOCEntry
+}
+
+var _ = (fs.NodeReadlinker)((*estargzLink)(nil))
+
+func (el *estargzLink) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	return []byte(el.ent.LinkName), 0
+}
+
+// estargzFile is a regular file, read lazily and verified chunk-by-chunk
+// against the eStargz table of contents.
+type estargzFile struct {
+	fs.Inode
+	r    *estargz.Reader
+	name string
+	ent  *estargz.TOCEntry
+
+	mu    sync.Mutex
+	cache map[int64][]byte
+	lru   []int64
+}
+
+var _ = (fs.NodeOpener)((*estargzFile)(nil))
+var _ = (fs.NodeReader)((*estargzFile)(nil))
+var _ = (fs.NodeGetattrer)((*estargzFile)(nil))
+
+func (ef *estargzFile) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = uint32(ef.ent.Mode) & 07777
+	out.Nlink = 1
+	out.Size = uint64(ef.ent.Size)
+	out.Mtime = uint64(ef.ent.ModTime().Unix())
+	out.Atime = out.Mtime
+	out.Ctime = out.Mtime
+	return 0
+}
+
+// Open is a no-op: content is fetched and verified lazily from Read.
+func (ef *estargzFile) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	return nil, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+// Read fills dest from one or more verified eStargz chunks starting at off,
+// fetching and verifying each chunk first if it is not already cached. A
+// single chunk is usually smaller than a FUSE read request (kernel
+// readahead, or any read(2) larger than the chunk size), so Read loops
+// across as many consecutive chunks as it takes to fill dest or reach the
+// file's actual end, rather than returning a short read that isn't at EOF.
+func (ef *estargzFile) Read(ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	size := ef.ent.Size
+	if off >= size {
+		return fuse.ReadResultData(nil), 0
+	}
+
+	want := int64(len(dest))
+	if off+want > size {
+		want = size - off
+	}
+
+	out := make([]byte, 0, want)
+	for int64(len(out)) < want {
+		pos := off + int64(len(out))
+
+		chunk, ok := ef.r.ChunkEntryForOffset(ef.name, pos)
+		if !ok {
+			return nil, syscall.EIO
+		}
+
+		data, err := ef.verifiedChunk(chunk)
+		if err != nil {
+			return nil, syscall.EIO
+		}
+
+		start := pos - chunk.ChunkOffset
+		if start < 0 || start > int64(len(data)) {
+			return nil, syscall.EIO
+		}
+		end := start + (want - int64(len(out)))
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		out = append(out, data[start:end]...)
+	}
+
+	return fuse.ReadResultData(out), 0
+}
+
+// verifiedChunk returns chunk's data, fetching and digest-verifying it on
+// first access and serving cached data afterwards.
+func (ef *estargzFile) verifiedChunk(chunk *estargz.TOCEntry) ([]byte, error) {
+	ef.mu.Lock()
+	defer ef.mu.Unlock()
+
+	if ef.cache == nil {
+		ef.cache = map[int64][]byte{}
+	}
+	if data, ok := ef.cache[chunk.ChunkOffset]; ok {
+		return data, nil
+	}
+
+	sr, err := ef.r.OpenFile(ef.name)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, chunk.ChunkSize)
+	if _, err := sr.ReadAt(data, chunk.ChunkOffset); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if err := verifyChunkDigest(data, chunk.ChunkDigest); err != nil {
+		return nil, errors.Wrapf(err, "verifying chunk at offset %d of %q", chunk.ChunkOffset, ef.name)
+	}
+
+	ef.cache[chunk.ChunkOffset] = data
+	ef.lru = append(ef.lru, chunk.ChunkOffset)
+	if len(ef.lru) > maxCachedChunks {
+		evict := ef.lru[0]
+		ef.lru = ef.lru[1:]
+		delete(ef.cache, evict)
+	}
+
+	return data, nil
+}
+
+// verifyChunkDigest checks data against a "sha256:<hex>"-formatted digest.
+func verifyChunkDigest(data []byte, wantDigest string) error {
+	if wantDigest == "" {
+		return errors.New("chunk has no recorded digest")
+	}
+	want := strings.TrimPrefix(wantDigest, "sha256:")
+	sum := sha256.Sum256(data)
+	got := hex.EncodeToString(sum[:])
+	if got != want {
+		return errors.Errorf("digest mismatch: want %s, got %s", want, got)
+	}
+	return nil
+}
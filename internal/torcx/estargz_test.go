@@ -0,0 +1,123 @@
+// Copyright 2021 Kinvolk GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+)
+
+// buildTestEstargz writes a single-file eStargz archive whose content is
+// chunked every chunkSize bytes, and returns the Reader opened over it.
+func buildTestEstargz(t *testing.T, content []byte, chunkSize int) *estargz.Reader {
+	t.Helper()
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	if err := tw.WriteHeader(&tar.Header{
+		Name: "file.bin",
+		Mode: 0644,
+		Size: int64(len(content)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var gzBuf bytes.Buffer
+	w := estargz.NewWriter(&gzBuf)
+	w.ChunkSize = chunkSize
+	if err := w.AppendTar(bytes.NewReader(tarBuf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := gzBuf.Bytes()
+	sr := io.NewSectionReader(bytes.NewReader(raw), 0, int64(len(raw)))
+	r, err := estargz.Open(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// TestEstargzFileReadSpansChunks checks that Read fills dest by stitching
+// together as many consecutive eStargz chunks as it takes, rather than
+// returning a short read the moment a single chunk boundary is hit.
+func TestEstargzFileReadSpansChunks(t *testing.T) {
+	const chunkSize = 4096
+	content := make([]byte, chunkSize*4)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	r := buildTestEstargz(t, content, chunkSize)
+	ent, ok := r.Lookup("file.bin")
+	if !ok {
+		t.Fatal("file.bin not found in test archive")
+	}
+
+	ef := &estargzFile{r: r, name: "file.bin", ent: ent}
+
+	dest := make([]byte, chunkSize*2+100)
+	res, errno := ef.Read(nil, nil, dest, 0)
+	if errno != 0 {
+		t.Fatalf("Read: errno %d", errno)
+	}
+
+	got, _ := res.Bytes(nil)
+	if len(got) != len(dest) {
+		t.Fatalf("got a short read of %d bytes, want %d", len(got), len(dest))
+	}
+	if !bytes.Equal(got, content[:len(dest)]) {
+		t.Fatal("read content does not match source content")
+	}
+}
+
+// TestEstargzFileReadStopsAtEOF checks that a read extending past the end of
+// the file returns exactly the remaining bytes, not an error.
+func TestEstargzFileReadStopsAtEOF(t *testing.T) {
+	const chunkSize = 4096
+	content := make([]byte, chunkSize+100)
+
+	r := buildTestEstargz(t, content, chunkSize)
+	ent, ok := r.Lookup("file.bin")
+	if !ok {
+		t.Fatal("file.bin not found in test archive")
+	}
+
+	ef := &estargzFile{r: r, name: "file.bin", ent: ent}
+
+	dest := make([]byte, chunkSize*2)
+	res, errno := ef.Read(nil, nil, dest, 0)
+	if errno != 0 {
+		t.Fatalf("Read: errno %d", errno)
+	}
+
+	got, _ := res.Bytes(nil)
+	if len(got) != len(content) {
+		t.Fatalf("got %d bytes, want %d (the file's actual size)", len(got), len(content))
+	}
+}
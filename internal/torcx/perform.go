@@ -17,18 +17,22 @@ package torcx
 import (
 	"archive/tar"
 	"bufio"
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/flatcar/torcx/internal/third_party/docker/pkg/loopback"
 	pkgtar "github.com/flatcar/torcx/pkg/tar"
+	"github.com/flatcar/torcx/pkg/verify"
+	"github.com/klauspost/pgzip"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
 	"golang.org/x/sys/unix"
 )
 
@@ -94,116 +98,209 @@ func ApplyProfile(applyCfg *ApplyConfig) error {
 	return nil
 }
 
-// applyImages unpacks and propagates assets from a list of images.
+// unpackParallelism returns the number of images applyImages unpacks and
+// propagates at once, defaulting to runtime.NumCPU() unless overridden by
+// ApplyConfig.UnpackParallelism.
+func unpackParallelism(applyCfg *ApplyConfig) int {
+	if applyCfg.UnpackParallelism > 0 {
+		return applyCfg.UnpackParallelism
+	}
+	return runtime.NumCPU()
+}
+
+// applyImages unpacks and propagates assets from a list of images. Images
+// are processed concurrently, bounded by unpackParallelism; each worker
+// opens its own StoreCache and writes to its own image-private topDir, so
+// no mutable state is shared across workers.
 func applyImages(applyCfg *ApplyConfig, images []Image) error {
 	if applyCfg == nil {
 		return errors.New("missing apply configuration")
 	}
 
+	failed := runBounded(len(images), unpackParallelism(applyCfg), func(i int) error {
+		return applyImage(applyCfg, &images[i])
+	})
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to install %d images", len(failed))
+	}
+
+	return nil
+}
+
+// runBounded calls fn(i) for every i in [0, n), running at most limit calls
+// concurrently, and returns the indices for which fn returned a non-nil
+// error. Callers are expected to log failures from within fn, since
+// runBounded itself only tracks which indices failed.
+func runBounded(n, limit int, fn func(i int) error) []int {
+	if limit <= 0 || limit > n {
+		limit = n
+	}
+
+	var (
+		mu     sync.Mutex
+		failed []int
+	)
+
+	sem := make(chan struct{}, limit)
+	var g errgroup.Group
+
+	for i := 0; i < n; i++ {
+		i := i
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if err := fn(i); err != nil {
+				mu.Lock()
+				failed = append(failed, i)
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+	// fn is expected to handle and log its own errors, so the group
+	// itself never returns one: Wait just joins the workers.
+	_ = g.Wait()
+
+	return failed
+}
+
+// fetchArchive resolves the Archive for an image, pulling directly from its
+// Remote when the remote is OCI-backed, and falling back to storeCache for
+// everything else (HTTP(S) remotes and already-cached local images).
+//
+// im.Reference is passed through as the pinned reference to pull, so that a
+// previously sealed digest (see below) is re-applied exactly rather than
+// re-resolving the board's moving tag. If the archive carries a resolved
+// digest, im.Reference is then updated to it, so that ApplyProfile seals the
+// exact content that was applied into the RunProfile for the next boot.
+func fetchArchive(applyCfg *ApplyConfig, storeCache *StoreCache, im *Image) (*Archive, error) {
+	if im.Remote != nil {
+		archive, err := im.Remote.Fetch("/usr", applyCfg.RunUnpackDir(), im.Name, im.Reference)
+		switch {
+		case err == nil:
+			if archive.Digest != "" {
+				im.Reference = archive.Digest
+			}
+			return archive, nil
+		case !errors.Is(err, ErrRemoteNotOCI):
+			return nil, err
+		}
+	}
+
+	return storeCache.ArchiveFor(*im)
+}
+
+// applyImage unpacks and propagates assets from a single image, logging and
+// returning a non-nil error on the first failed step.
+func applyImage(applyCfg *ApplyConfig, im *Image) error {
+	// Some log fields we keep using
+	logFields := logrus.Fields{
+		"image":     im.Name,
+		"reference": im.Reference,
+	}
+
 	storeCache, err := NewStoreCache(applyCfg.StorePaths)
 	if err != nil {
+		logrus.WithFields(logFields).Error(err)
 		return err
 	}
 
-	// Unpack all images, continuing on error
-	failedImages := []Image{}
+	archive, err := fetchArchive(applyCfg, storeCache, im)
+	if err != nil {
+		logrus.WithFields(logFields).Error(err)
+		return err
+	}
+	logFields["reference"] = im.Reference
 
-	for _, im := range images {
-		// Some log fields we keep using
-		logFields := logrus.Fields{
-			"image":     im.Name,
-			"reference": im.Reference,
+	if policy := im.Remote.verificationPolicy(); !policy.Empty() {
+		if err := verify.Archive(archive.Filepath, policy); err != nil {
+			logrus.WithFields(logFields).Error("failed to verify image: ", err)
+			return err
 		}
+		logrus.WithFields(logFields).Debug("image signature verified")
+	}
 
-		archive, err := storeCache.ArchiveFor(im)
-		if err != nil {
-			logrus.WithFields(logFields).Error(err)
-			failedImages = append(failedImages, im)
-			continue
-		}
+	var imageRoot string
+	switch archive.Format {
+	case ArchiveFormatTgz:
+		imageRoot, err = unpackTgz(applyCfg, archive.Filepath, im.Name)
+	case ArchiveFormatSquashfs:
+		imageRoot, err = mountSquashfs(applyCfg, archive.Filepath, im.Name)
+	case ArchiveFormatEstargz:
+		imageRoot, err = mountEstargz(applyCfg, archive.Filepath, im.Name)
+	default:
+		err = fmt.Errorf("unrecognized format for archive: %q", archive)
+	}
+	if err != nil {
+		logrus.WithFields(logFields).Error("failed to unpack: ", err)
+		return err
+	}
+	logFields["path"] = imageRoot
+	logrus.WithFields(logFields).Debug("image unpacked")
 
-		var imageRoot string
-		switch archive.Format {
-		case ArchiveFormatTgz:
-			imageRoot, err = unpackTgz(applyCfg, archive.Filepath, im.Name)
-		case ArchiveFormatSquashfs:
-			imageRoot, err = mountSquashfs(applyCfg, archive.Filepath, im.Name)
-		default:
-			err = fmt.Errorf("unrecognized format for archive: %q", archive)
-		}
-		if err != nil {
-			failedImages = append(failedImages, im)
-			logrus.WithFields(logFields).Error("failed to unpack: ", err)
-			continue
-		}
-		logFields["path"] = imageRoot
-		logrus.WithFields(logFields).Debug("image unpacked")
+	assets, err := retrieveAssets(applyCfg, imageRoot)
+	if err != nil {
+		logrus.WithFields(logFields).Error("failed retrieving assets from image: ", err)
+		return err
+	}
 
-		assets, err := retrieveAssets(applyCfg, imageRoot)
-		if err != nil {
-			failedImages = append(failedImages, im)
-			logrus.WithFields(logFields).Error("failed retrieving assets from image: ", err)
-			continue
+	if len(assets.Binaries) > 0 {
+		if err := propagateBins(applyCfg, imageRoot, assets.Binaries); err != nil {
+			logrus.WithFields(logFields).WithField("assets", assets.Binaries).Error("failed to propagate binaries: ", err)
+			return err
 		}
+		logrus.WithFields(logFields).WithField("assets", assets.Binaries).Debug("binaries propagated")
+	}
 
-		if len(assets.Binaries) > 0 {
-			if err := propagateBins(applyCfg, imageRoot, assets.Binaries); err != nil {
-				failedImages = append(failedImages, im)
-				logrus.WithFields(logFields).WithField("assets", assets.Binaries).Error("failed to propagate binaries: ", err)
-				continue
-			}
-			logrus.WithFields(logFields).WithField("assets", assets.Binaries).Debug("binaries propagated")
+	if len(assets.Network) > 0 {
+		if err := propagateNetworkdUnits(applyCfg, imageRoot, assets.Network); err != nil {
+			logrus.WithFields(logFields).WithField("assets", assets.Network).Error("failed to propagate networkd units: ", err)
+			return err
 		}
 
-		if len(assets.Network) > 0 {
-			if err := propagateNetworkdUnits(applyCfg, imageRoot, assets.Network); err != nil {
-				failedImages = append(failedImages, im)
-				logrus.WithFields(logFields).WithField("assets", assets.Network).Error("failed to propagate networkd units: ", err)
-				continue
-			}
-
-			logrus.WithFields(logFields).WithField("assets", assets.Network).Debug("networkd units propagated")
-		}
+		logrus.WithFields(logFields).WithField("assets", assets.Network).Debug("networkd units propagated")
+	}
 
-		if len(assets.Units) > 0 {
-			if err := propagateSystemdUnits(applyCfg, imageRoot, assets.Units); err != nil {
-				failedImages = append(failedImages, im)
-				logrus.WithFields(logFields).WithField("assets", assets.Units).Error("failed to propagate systemd units: ", err)
-				continue
-			}
-			logrus.WithFields(logFields).WithField("assets", assets.Units).Debug("systemd units propagated")
+	if len(assets.Units) > 0 {
+		if err := propagateSystemdUnits(applyCfg, imageRoot, assets.Units); err != nil {
+			logrus.WithFields(logFields).WithField("assets", assets.Units).Error("failed to propagate systemd units: ", err)
+			return err
 		}
+		logrus.WithFields(logFields).WithField("assets", assets.Units).Debug("systemd units propagated")
+	}
 
-		if len(assets.Sysusers) > 0 {
-			if err := propagateSysusersUnits(applyCfg, imageRoot, assets.Sysusers); err != nil {
-				failedImages = append(failedImages, im)
-				logrus.WithFields(logFields).WithField("assets", assets.Sysusers).Error("failed to propagate sysusers: ", err)
-				continue
-			}
-			logrus.WithFields(logFields).WithField("assets", assets.Sysusers).Debug("sysusers propagated")
+	if len(assets.Sysusers) > 0 {
+		if err := propagateSysusersUnits(applyCfg, imageRoot, assets.Sysusers); err != nil {
+			logrus.WithFields(logFields).WithField("assets", assets.Sysusers).Error("failed to propagate sysusers: ", err)
+			return err
 		}
+		logrus.WithFields(logFields).WithField("assets", assets.Sysusers).Debug("sysusers propagated")
+	}
 
-		if len(assets.Tmpfiles) > 0 {
-			if err := propagateTmpfilesUnits(applyCfg, imageRoot, assets.Tmpfiles); err != nil {
-				failedImages = append(failedImages, im)
-				logrus.WithFields(logFields).WithField("assets", assets.Units).Error("failed to propagate tmpfiles: ", err)
-				continue
-			}
-			logrus.WithFields(logFields).WithField("assets", assets.Units).Debug("tmpfiles propagated")
+	if len(assets.Tmpfiles) > 0 {
+		if err := propagateTmpfilesUnits(applyCfg, imageRoot, assets.Tmpfiles); err != nil {
+			logrus.WithFields(logFields).WithField("assets", assets.Units).Error("failed to propagate tmpfiles: ", err)
+			return err
 		}
+		logrus.WithFields(logFields).WithField("assets", assets.Units).Debug("tmpfiles propagated")
+	}
 
-		if len(assets.UdevRules) > 0 {
-			if err := propagateUdevRules(applyCfg, imageRoot, assets.UdevRules); err != nil {
-				failedImages = append(failedImages, im)
-				logrus.WithFields(logFields).WithField("assets", assets.UdevRules).Error("failed to propagate udev rules: ", err)
-				continue
-			}
-			logrus.WithFields(logFields).WithField("assets", assets.UdevRules).Debug("udev rules propagated")
+	if len(assets.UdevRules) > 0 {
+		if err := propagateUdevRules(applyCfg, imageRoot, assets.UdevRules); err != nil {
+			logrus.WithFields(logFields).WithField("assets", assets.UdevRules).Error("failed to propagate udev rules: ", err)
+			return err
 		}
+		logrus.WithFields(logFields).WithField("assets", assets.UdevRules).Debug("udev rules propagated")
 	}
 
-	if len(failedImages) > 0 {
-		return fmt.Errorf("failed to install %d images", len(failedImages))
+	if len(assets.CNI) > 0 {
+		if err := propagateCNI(applyCfg, imageRoot, assets.CNI); err != nil {
+			logrus.WithFields(logFields).WithField("assets", assets.CNI).Error("failed to propagate CNI assets: ", err)
+			return err
+		}
+		logrus.WithFields(logFields).WithField("assets", assets.CNI).Debug("CNI assets propagated")
 	}
 
 	return nil
@@ -320,7 +417,7 @@ func unpackTgz(applyCfg *ApplyConfig, tgzPath, imageName string) (string, error)
 	}
 	defer fp.Close()
 
-	gr, err := gzip.NewReader(fp)
+	gr, err := pgzip.NewReader(fp)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,223 @@
+// Copyright 2021 Kinvolk GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestRunBoundedFailureIsolation checks that a failing item does not stop
+// the rest of the batch from running, and that every failed index (and
+// only those) is reported back.
+func TestRunBoundedFailureIsolation(t *testing.T) {
+	const n = 20
+	var ran [n]int32
+
+	failed := runBounded(n, 4, func(i int) error {
+		atomic.AddInt32(&ran[i], 1)
+		if i%3 == 0 {
+			return fmt.Errorf("synthetic failure for item %d", i)
+		}
+		return nil
+	})
+
+	for i := 0; i < n; i++ {
+		if atomic.LoadInt32(&ran[i]) != 1 {
+			t.Fatalf("item %d ran %d times, want exactly once", i, ran[i])
+		}
+	}
+
+	wantFailed := map[int]bool{}
+	for i := 0; i < n; i++ {
+		if i%3 == 0 {
+			wantFailed[i] = true
+		}
+	}
+	if len(failed) != len(wantFailed) {
+		t.Fatalf("got %d failed indices, want %d", len(failed), len(wantFailed))
+	}
+	for _, i := range failed {
+		if !wantFailed[i] {
+			t.Fatalf("unexpected failed index %d", i)
+		}
+	}
+}
+
+// TestRunBoundedConcurrencyLimit checks that no more than limit calls to fn
+// run at once, regardless of how many items there are.
+func TestRunBoundedConcurrencyLimit(t *testing.T) {
+	const n = 16
+	const limit = 4
+	var inFlight, maxInFlight int32
+
+	runBounded(n, limit, func(i int) error {
+		cur := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if cur <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, cur) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+
+	if maxInFlight > limit {
+		t.Fatalf("observed %d concurrent calls, want at most %d", maxInFlight, limit)
+	}
+}
+
+// TestRunBoundedSpeedup checks that spreading n slow items across a
+// worker pool is faster than running them one at a time, i.e. that
+// applyImages' use of runBounded actually parallelizes image unpacking
+// rather than just reordering it.
+func TestRunBoundedSpeedup(t *testing.T) {
+	const n = 8
+	const work = 20 * time.Millisecond
+
+	sequential := time.Duration(0)
+	for i := 0; i < n; i++ {
+		start := time.Now()
+		time.Sleep(work)
+		sequential += time.Since(start)
+	}
+
+	start := time.Now()
+	runBounded(n, n, func(i int) error {
+		time.Sleep(work)
+		return nil
+	})
+	parallel := time.Since(start)
+
+	if parallel >= sequential {
+		t.Fatalf("parallel run (%s) was not faster than sequential run (%s)", parallel, sequential)
+	}
+}
+
+// writeSyntheticImage simulates unpacking a single image: it writes a small,
+// name-derived file tree under destDir/name and sleeps for work, standing in
+// for the real disk I/O and decompression applyImage would otherwise do.
+func writeSyntheticImage(destDir, name string, work time.Duration) error {
+	time.Sleep(work)
+
+	imageDir := filepath.Join(destDir, name)
+	if err := os.MkdirAll(filepath.Join(imageDir, "bin"), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(imageDir, "bin", "tool"), []byte(name+" binary"), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(imageDir, "manifest.txt"), []byte(name+" manifest"), 0644)
+}
+
+// treeFiles walks root and returns a sorted list of "relpath:content" pairs,
+// so two trees can be compared for an identical on-disk layout regardless of
+// the order their files were written in.
+func treeFiles(t *testing.T, root string) []string {
+	t.Helper()
+
+	var out []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		out = append(out, rel+":"+string(content))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walking %q: %s", root, err)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// TestParallelApplyMatchesSequentialLayout applies n synthetic images through
+// runBounded, the same primitive applyImages uses, both in parallel and
+// sequentially (limit=1), and checks that the parallel run is faster but
+// produces a byte-for-byte identical on-disk layout, since each worker only
+// ever touches its own image-private subtree.
+func TestParallelApplyMatchesSequentialLayout(t *testing.T) {
+	const n = 8
+	const work = 20 * time.Millisecond
+
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("image-%d", i)
+	}
+
+	parallelDir := t.TempDir()
+	start := time.Now()
+	if failed := runBounded(n, n, func(i int) error {
+		return writeSyntheticImage(parallelDir, names[i], work)
+	}); len(failed) > 0 {
+		t.Fatalf("parallel run: %d images failed", len(failed))
+	}
+	parallel := time.Since(start)
+
+	sequentialDir := t.TempDir()
+	start = time.Now()
+	if failed := runBounded(n, 1, func(i int) error {
+		return writeSyntheticImage(sequentialDir, names[i], work)
+	}); len(failed) > 0 {
+		t.Fatalf("sequential run: %d images failed", len(failed))
+	}
+	sequential := time.Since(start)
+
+	if parallel >= sequential {
+		t.Fatalf("parallel run (%s) was not faster than sequential run (%s)", parallel, sequential)
+	}
+
+	parallelFiles := treeFiles(t, parallelDir)
+	sequentialFiles := treeFiles(t, sequentialDir)
+	if len(parallelFiles) != len(sequentialFiles) {
+		t.Fatalf("parallel produced %d files, sequential produced %d", len(parallelFiles), len(sequentialFiles))
+	}
+	for i := range parallelFiles {
+		if parallelFiles[i] != sequentialFiles[i] {
+			t.Fatalf("on-disk layout differs at entry %d: parallel %q, sequential %q", i, parallelFiles[i], sequentialFiles[i])
+		}
+	}
+}
+
+func TestUnpackParallelism(t *testing.T) {
+	cfg := &ApplyConfig{UnpackParallelism: 3}
+	if got := unpackParallelism(cfg); got != 3 {
+		t.Fatalf("got %d, want 3", got)
+	}
+
+	cfg = &ApplyConfig{}
+	if got := unpackParallelism(cfg); got <= 0 {
+		t.Fatalf("got %d, want a positive default", got)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2018 CoreOS Inc.
+// Copyright 2020 Kinvolk GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/euank/gotmpl"
+	"github.com/flatcar/torcx/pkg/verify"
+	"github.com/pkg/errors"
+)
+
+var (
+	// errNilRemote is returned when evaluating a URL against a nil Remote
+	errNilRemote = errors.New("remote is nil")
+	// errEmptyUsrMountpoint is returned when no usr mountpoint was given
+	errEmptyUsrMountpoint = errors.New("empty usr mountpoint")
+	// errEmptyTemplateURL is returned when a Remote has no template URL
+	errEmptyTemplateURL = errors.New("empty template URL")
+)
+
+// RemoteType selects how a Remote's TemplateURL is interpreted and fetched.
+type RemoteType string
+
+const (
+	// RemoteTypeHTTP fetches a plain tarball/squashfs archive over HTTP(S).
+	RemoteTypeHTTP RemoteType = "http"
+	// RemoteTypeOCI fetches an addon image from an OCI registry.
+	RemoteTypeOCI RemoteType = "oci"
+)
+
+// Remote describes an upstream source of torcx addon archives, templated
+// against the running OS release so that a single configuration can resolve
+// to board- and version-specific content.
+type Remote struct {
+	// TemplateURL is the templated location of the remote content. It may
+	// reference `${ID}`, `${VERSION_ID}`, `${COREOS_BOARD}`/`${FLATCAR_BOARD}`,
+	// and `${COREOS_USR}`/`${FLATCAR_USR}`.
+	TemplateURL string `json:"templateUrl"`
+
+	// RemoteType selects how TemplateURL is fetched. If empty, it is
+	// auto-detected from the URL scheme (an `oci://` scheme, or a bare
+	// registry/repository reference, selects RemoteTypeOCI).
+	RemoteType RemoteType `json:"remoteType,omitempty"`
+
+	// CredentialFile optionally points at a docker-style `config.json`
+	// used to authenticate against the registry, instead of the ambient
+	// `$DOCKER_CONFIG`. Only meaningful for RemoteTypeOCI.
+	CredentialFile string `json:"credentialFile,omitempty"`
+
+	// Verification, if set, rejects any archive fetched from this remote
+	// whose detached signature does not check out.
+	Verification *VerificationPolicy `json:"verification,omitempty"`
+}
+
+// VerificationPolicy configures how archives fetched from a Remote are
+// signature-checked before they are unpacked. Exactly one of PublicKeys or
+// Keyless should be set.
+type VerificationPolicy struct {
+	// PublicKeys are PEM-encoded ed25519 or ECDSA public keys. An archive
+	// verifies if its signature matches any one of them.
+	PublicKeys []string `json:"publicKeys,omitempty"`
+	// Keyless, if set, verifies archives against a Fulcio-issued
+	// certificate and a Rekor inclusion proof instead.
+	Keyless *KeylessVerificationPolicy `json:"keyless,omitempty"`
+}
+
+// KeylessVerificationPolicy configures keyless signature verification.
+type KeylessVerificationPolicy struct {
+	// RootCertsPEM is a bundle of CA certificates that signing
+	// certificates must chain up to (typically Fulcio's root).
+	RootCertsPEM string `json:"rootCertsPem"`
+	// RekorPublicKeyPEM is the Rekor transparency log's public key.
+	RekorPublicKeyPEM string `json:"rekorPublicKeyPem"`
+	// AllowedIssuers restricts which OIDC issuers a signing identity may
+	// have been certified under.
+	AllowedIssuers []string `json:"allowedIssuers,omitempty"`
+	// AllowedSANs restricts which subject alternative names a signing
+	// certificate may carry.
+	AllowedSANs []string `json:"allowedSans,omitempty"`
+}
+
+// verificationPolicy translates this remote's VerificationPolicy into the
+// form expected by pkg/verify.
+func (r *Remote) verificationPolicy() verify.Policy {
+	if r == nil || r.Verification == nil {
+		return verify.Policy{}
+	}
+
+	policy := verify.Policy{PublicKeys: r.Verification.PublicKeys}
+	if kl := r.Verification.Keyless; kl != nil {
+		policy.Keyless = &verify.KeylessPolicy{
+			RootCertsPEM:      []byte(kl.RootCertsPEM),
+			RekorPublicKeyPEM: []byte(kl.RekorPublicKeyPEM),
+			AllowedIssuers:    kl.AllowedIssuers,
+			AllowedSANs:       kl.AllowedSANs,
+		}
+	}
+
+	return policy
+}
+
+// evaluateURL expands this remote's TemplateURL against the OS release
+// found under usrMountpoint, returning the resulting URL.
+func (r *Remote) evaluateURL(usrMountpoint string) (*url.URL, error) {
+	if r == nil {
+		return nil, errNilRemote
+	}
+	if usrMountpoint == "" {
+		return nil, errEmptyUsrMountpoint
+	}
+	if r.TemplateURL == "" {
+		return nil, errEmptyTemplateURL
+	}
+
+	osRelease, err := parseOsRelease(VendorOsReleasePath(usrMountpoint))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing os-release")
+	}
+
+	board := osRelease["FLATCAR_BOARD"]
+	if board == "" {
+		board = osRelease["COREOS_BOARD"]
+	}
+
+	lookup := gotmpl.MapLookup{
+		"ID":            osRelease["ID"],
+		"VERSION_ID":    osRelease["VERSION_ID"],
+		"COREOS_BOARD":  board,
+		"FLATCAR_BOARD": board,
+		"COREOS_USR":    usrMountpoint,
+		"FLATCAR_USR":   usrMountpoint,
+	}
+
+	rendered, err := gotmpl.TemplateString(r.TemplateURL, lookup)
+	if err != nil {
+		return nil, errors.Wrapf(err, "templating %q", r.TemplateURL)
+	}
+
+	res, err := url.Parse(rendered)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %q", rendered)
+	}
+
+	return res, nil
+}
+
+// effectiveType returns the RemoteType this remote should be fetched with,
+// auto-detecting from the templated URL scheme when RemoteType is unset.
+func (r *Remote) effectiveType(resolved *url.URL) RemoteType {
+	if r.RemoteType != "" {
+		return r.RemoteType
+	}
+	if resolved.Scheme == "oci" {
+		return RemoteTypeOCI
+	}
+	if resolved.Scheme == "" && resolved.Host == "" {
+		// Neither an http(s) nor oci:// URL: treat as a bare image
+		// reference, e.g. "registry.example.com/flatcar/docker:tag".
+		return RemoteTypeOCI
+	}
+	return RemoteTypeHTTP
+}
+
+// VendorOsReleasePath returns the path to the vendor os-release file under
+// a given usr mountpoint.
+func VendorOsReleasePath(usrMountpoint string) string {
+	return filepath.Join(usrMountpoint, "lib", "os-release")
+}
+
+// parseOsRelease parses a systemd-style os-release file into a key/value map.
+func parseOsRelease(path string) (map[string]string, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %q", path)
+	}
+	defer fp.Close()
+
+	kv := map[string]string{}
+	sc := bufio.NewScanner(fp)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		kv[parts[0]] = strings.Trim(parts[1], `"`)
+	}
+	if sc.Err() != nil {
+		return nil, errors.Wrap(sc.Err(), "failed to parse os-release file")
+	}
+
+	return kv, nil
+}
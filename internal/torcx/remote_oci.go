@@ -0,0 +1,242 @@
+// Copyright 2020 Kinvolk GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/klauspost/pgzip"
+	"github.com/pkg/errors"
+)
+
+// ErrRemoteNotOCI is returned by Remote.Fetch when the remote's resolved
+// URL is not OCI-backed, so callers should fall back to their default fetch
+// path (e.g. StoreCache.ArchiveFor) for HTTP(S) and other non-OCI sources.
+var ErrRemoteNotOCI = errors.New("remote is not OCI-backed")
+
+// boardPlatforms maps a FLATCAR_BOARD value to the GOOS/GOARCH pair used to
+// pick a single manifest out of a multi-platform OCI image index.
+var boardPlatforms = map[string]v1.Platform{
+	"amd64-usr": {OS: "linux", Architecture: "amd64"},
+	"arm64-usr": {OS: "linux", Architecture: "arm64"},
+}
+
+// OCIPullResult describes an OCI image that was pulled and flattened onto
+// disk, including the digest it was resolved to so that callers can pin
+// future fetches to the exact same content.
+type OCIPullResult struct {
+	// Filepath is the flattened tgz rootfs archive on disk.
+	Filepath string
+	// Digest is the pulled reference pinned to the resolved manifest
+	// digest, e.g. "registry.example.com/repo@sha256:...", so that a
+	// future fetch can be pinned to the exact content that was applied.
+	Digest string
+}
+
+// Fetch retrieves this remote's content into destDir under imageName and
+// returns the resulting Archive, ready for applyImage to unpack. fetchArchive
+// calls it for images backed by a Remote, before falling back to
+// StoreCache.ArchiveFor.
+//
+// If pinnedReference is non-empty (typically Image.Reference, sealed from a
+// previous Fetch's resolved Archive.Digest), it is pulled directly instead
+// of re-resolving TemplateURL, so a reboot re-applies the exact content that
+// was previously applied rather than whatever the board's moving tag now
+// points at.
+//
+// Fetch only handles OCI-backed remotes; it returns ErrRemoteNotOCI for
+// anything else, so that callers can fall back to their default fetch path
+// for HTTP(S) remotes and already-cached local images.
+func (r *Remote) Fetch(usrMountpoint, destDir, imageName, pinnedReference string) (*Archive, error) {
+	resolved, err := r.evaluateURL(usrMountpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolving remote URL")
+	}
+
+	if r.effectiveType(resolved) != RemoteTypeOCI {
+		return nil, ErrRemoteNotOCI
+	}
+
+	res, err := r.fetchOCI(usrMountpoint, destDir, imageName, pinnedReference)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Archive{Format: ArchiveFormatTgz, Filepath: res.Filepath, Digest: res.Digest}, nil
+}
+
+// fetchOCI resolves this remote's TemplateURL to an OCI image reference,
+// pulls the image from its registry, and flattens it into a gzip-compressed
+// tgz rootfs archive under destDir, ready for unpackTgz.
+//
+// If the reference resolves to a multi-platform image index, the manifest
+// matching the running FLATCAR_BOARD is selected automatically, so a single
+// TemplateURL without `${FLATCAR_BOARD}` templating is enough to cover all
+// boards. If pinnedReference is non-empty, it is pulled as-is instead: a
+// digest-pinned reference already names a single manifest, so there is
+// nothing left to select.
+//
+// Credentials are taken from the ambient Docker config (honoring
+// $DOCKER_CONFIG) via authn.DefaultKeychain, unless r.CredentialFile points
+// at a per-remote docker-style config.json to use instead.
+func (r *Remote) fetchOCI(usrMountpoint, destDir, imageName, pinnedReference string) (*OCIPullResult, error) {
+	ref := pinnedReference
+	var platform *v1.Platform
+	if ref == "" {
+		resolved, err := r.evaluateURL(usrMountpoint)
+		if err != nil {
+			return nil, errors.Wrap(err, "resolving OCI reference")
+		}
+		ref = strings.TrimPrefix(resolved.String(), "oci://")
+
+		platform, err = boardPlatform(usrMountpoint)
+		if err != nil {
+			return nil, errors.Wrap(err, "selecting OCI platform")
+		}
+	}
+
+	keychain := authn.Keychain(authn.DefaultKeychain)
+	if r.CredentialFile != "" {
+		kc, err := newFileKeychain(r.CredentialFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "loading credential file %q", r.CredentialFile)
+		}
+		keychain = kc
+	}
+
+	opts := []crane.Option{crane.WithAuthFromKeychain(keychain)}
+	if platform != nil {
+		opts = append(opts, crane.WithPlatform(platform))
+	}
+
+	img, err := crane.Pull(ref, opts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "pulling OCI image %q", ref)
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolving digest for %q", ref)
+	}
+
+	repo, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %q", ref)
+	}
+	pinned := repo.Context().Digest(digest.String()).String()
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return nil, err
+	}
+	destPath := filepath.Join(destDir, imageName+".torcx.tgz")
+
+	fp, err := os.Create(destPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	// crane.Export writes a plain, uncompressed tar: gzip it ourselves so
+	// that unpackTgz's pgzip.NewReader can read it back.
+	gw := pgzip.NewWriter(fp)
+	if err := crane.Export(img, gw); err != nil {
+		return nil, errors.Wrapf(err, "exporting OCI image %q", ref)
+	}
+	if err := gw.Close(); err != nil {
+		return nil, errors.Wrapf(err, "flushing %q", destPath)
+	}
+
+	return &OCIPullResult{Filepath: destPath, Digest: pinned}, nil
+}
+
+// boardPlatform returns the v1.Platform matching the FLATCAR_BOARD of the
+// os-release found under usrMountpoint, to select a manifest out of a
+// multi-platform OCI image index.
+func boardPlatform(usrMountpoint string) (*v1.Platform, error) {
+	osRelease, err := parseOsRelease(VendorOsReleasePath(usrMountpoint))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing os-release")
+	}
+
+	board := osRelease["FLATCAR_BOARD"]
+	if board == "" {
+		board = osRelease["COREOS_BOARD"]
+	}
+
+	platform, ok := boardPlatforms[board]
+	if !ok {
+		return nil, errors.Errorf("unrecognized board %q", board)
+	}
+
+	return &platform, nil
+}
+
+// fileKeychain is an authn.Keychain backed by a single docker-style
+// config.json, rather than the ambient Docker config directory.
+type fileKeychain struct {
+	configPath string
+}
+
+// newFileKeychain builds a fileKeychain, falling back to the ambient Docker
+// config for any registry it has no entry for.
+func newFileKeychain(configPath string) (authn.Keychain, error) {
+	if _, err := os.Stat(configPath); err != nil {
+		return nil, err
+	}
+	return authn.NewMultiKeychain(&fileKeychain{configPath: configPath}, authn.DefaultKeychain), nil
+}
+
+// Resolve implements authn.Keychain.
+func (fk *fileKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	fp, err := os.Open(fk.configPath)
+	if err != nil {
+		return authn.Anonymous, err
+	}
+	defer fp.Close()
+
+	cf, err := dockerconfig.LoadFromReader(fp)
+	if err != nil {
+		return authn.Anonymous, err
+	}
+
+	key := target.RegistryStr()
+	if key == name.DefaultRegistry {
+		key = authn.DefaultAuthKey
+	}
+
+	cfg, err := cf.GetAuthConfig(key)
+	if err != nil {
+		return authn.Anonymous, err
+	}
+	if (cfg == types.AuthConfig{}) {
+		return authn.Anonymous, nil
+	}
+
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		Auth:          cfg.Auth,
+		IdentityToken: cfg.IdentityToken,
+		RegistryToken: cfg.RegistryToken,
+	}), nil
+}
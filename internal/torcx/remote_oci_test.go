@@ -0,0 +1,210 @@
+// Copyright 2020 Kinvolk GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/klauspost/pgzip"
+)
+
+// writeOsRelease writes a minimal os-release file under usrMountpoint/lib,
+// as evaluateURL and boardPlatform expect to find it.
+func writeOsRelease(t *testing.T, usrMountpoint, board string) {
+	t.Helper()
+
+	libDir := filepath.Join(usrMountpoint, "lib")
+	if err := os.MkdirAll(libDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := "ID=flatcar\nVERSION_ID=2705.0.0\nFLATCAR_BOARD=" + board + "\n"
+	if err := ioutil.WriteFile(filepath.Join(libDir, "os-release"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRemoteFetchOCI exercises Remote.Fetch end-to-end against a local
+// registry: an image is pushed, pulled back through fetchOCI, and the
+// resulting archive must be a valid gzip-compressed tarball that unpackTgz
+// can read, since crane.Export itself only ever writes a plain tar.
+func TestRemoteFetchOCI(t *testing.T) {
+	srv := httptest.NewServer(registry.New())
+	defer srv.Close()
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref := srv.Listener.Addr().String() + "/test/image:latest"
+	if err := crane.Push(img, ref); err != nil {
+		t.Fatalf("pushing test image: %s", err)
+	}
+
+	usrMountpoint := t.TempDir()
+	writeOsRelease(t, usrMountpoint, "amd64-usr")
+
+	r := &Remote{TemplateURL: "oci://" + ref}
+	destDir := t.TempDir()
+
+	archive, err := r.Fetch(usrMountpoint, destDir, "test-image", "")
+	if err != nil {
+		t.Fatalf("Fetch: %s", err)
+	}
+	if archive.Format != ArchiveFormatTgz {
+		t.Fatalf("got format %q, want %q", archive.Format, ArchiveFormatTgz)
+	}
+	if archive.Digest == "" {
+		t.Fatal("expected a digest-pinned reference")
+	}
+
+	fp, err := os.Open(archive.Filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	gr, err := pgzip.NewReader(fp)
+	if err != nil {
+		t.Fatalf("exported archive is not valid gzip: %s", err)
+	}
+	defer gr.Close()
+
+	if _, err := tar.NewReader(gr).Next(); err != nil {
+		t.Fatalf("exported archive is not a readable tar: %s", err)
+	}
+}
+
+// TestRemoteFetchNotOCI checks that Fetch reports ErrRemoteNotOCI for a
+// plain HTTP(S) remote, so callers know to fall back to their default fetch
+// path instead of treating it as a pull failure.
+func TestRemoteFetchNotOCI(t *testing.T) {
+	usrMountpoint := t.TempDir()
+	writeOsRelease(t, usrMountpoint, "amd64-usr")
+
+	r := &Remote{TemplateURL: "https://example.com/addon.tgz"}
+	if _, err := r.Fetch(usrMountpoint, t.TempDir(), "addon", ""); err != ErrRemoteNotOCI {
+		t.Fatalf("got %v, want %v", err, ErrRemoteNotOCI)
+	}
+}
+
+// TestRemoteFetchOCIMultiPlatformIndex pushes a two-platform OCI image
+// index and checks that fetchOCI selects the manifest matching the running
+// FLATCAR_BOARD rather than, say, the first entry in the index.
+func TestRemoteFetchOCIMultiPlatformIndex(t *testing.T) {
+	srv := httptest.NewServer(registry.New())
+	defer srv.Close()
+
+	amd64Img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arm64Img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	amd64Digest, err := amd64Img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{
+			Add: arm64Img,
+			Descriptor: v1.Descriptor{
+				Platform: &v1.Platform{OS: "linux", Architecture: "arm64"},
+			},
+		},
+		mutate.IndexAddendum{
+			Add: amd64Img,
+			Descriptor: v1.Descriptor{
+				Platform: &v1.Platform{OS: "linux", Architecture: "amd64"},
+			},
+		},
+	)
+
+	ref := srv.Listener.Addr().String() + "/test/multiarch:latest"
+	refName, err := name.ParseReference(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(refName, idx); err != nil {
+		t.Fatalf("pushing test index: %s", err)
+	}
+
+	usrMountpoint := t.TempDir()
+	writeOsRelease(t, usrMountpoint, "amd64-usr")
+
+	r := &Remote{TemplateURL: "oci://" + ref}
+	archive, err := r.Fetch(usrMountpoint, t.TempDir(), "multiarch", "")
+	if err != nil {
+		t.Fatalf("Fetch: %s", err)
+	}
+
+	if !strings.Contains(archive.Digest, amd64Digest.String()) {
+		t.Fatalf("got digest %q, want it pinned to the amd64 manifest %q", archive.Digest, amd64Digest)
+	}
+}
+
+// TestRemoteFetchOCIPinnedReference checks that a non-empty pinnedReference
+// is pulled as-is, skipping the board lookup and platform selection, the way
+// fetchArchive uses a previously sealed Image.Reference on a later boot.
+func TestRemoteFetchOCIPinnedReference(t *testing.T) {
+	srv := httptest.NewServer(registry.New())
+	defer srv.Close()
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := srv.Listener.Addr().String() + "/test/pinned:latest"
+	if err := crane.Push(img, ref); err != nil {
+		t.Fatalf("pushing test image: %s", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned := srv.Listener.Addr().String() + "/test/pinned@" + digest.String()
+
+	// No FLATCAR_BOARD at all: boardPlatform would fail on this os-release,
+	// so reaching it would fail the test. A pinned reference must not need
+	// to select a platform.
+	usrMountpoint := t.TempDir()
+	writeOsRelease(t, usrMountpoint, "")
+
+	r := &Remote{TemplateURL: "oci://" + ref}
+	archive, err := r.Fetch(usrMountpoint, t.TempDir(), "pinned", pinned)
+	if err != nil {
+		t.Fatalf("Fetch with pinned reference: %s", err)
+	}
+	if !strings.Contains(archive.Digest, digest.String()) {
+		t.Fatalf("got digest %q, want it pinned to %q", archive.Digest, digest)
+	}
+}
@@ -17,6 +17,7 @@ package torcx
 
 import (
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"testing"
@@ -51,6 +52,140 @@ func TestBasicEvaluateURL(t *testing.T) {
 	}
 }
 
+// TestEffectiveType checks RemoteType auto-detection from a resolved URL's
+// scheme, including the bare "registry.example.com/repo:tag" case that has
+// neither a scheme nor an http(s) host.
+func TestEffectiveType(t *testing.T) {
+	mustParse := func(raw string) *url.URL {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %s", raw, err)
+		}
+		return u
+	}
+
+	testCases := []struct {
+		name       string
+		remoteType RemoteType
+		resolved   *url.URL
+		want       RemoteType
+	}{
+		{
+			name:       "explicit HTTP type wins over oci scheme",
+			remoteType: RemoteTypeHTTP,
+			resolved:   mustParse("oci://registry.example.com/flatcar/docker:2705.0.0"),
+			want:       RemoteTypeHTTP,
+		},
+		{
+			name:       "explicit OCI type wins over http URL",
+			remoteType: RemoteTypeOCI,
+			resolved:   mustParse("https://example.com/addon.tgz"),
+			want:       RemoteTypeOCI,
+		},
+		{
+			name:     "oci scheme",
+			resolved: mustParse("oci://registry.example.com/flatcar/docker:2705.0.0"),
+			want:     RemoteTypeOCI,
+		},
+		{
+			name:     "bare image reference",
+			resolved: mustParse("registry.example.com/flatcar/docker:2705.0.0"),
+			want:     RemoteTypeOCI,
+		},
+		{
+			name:     "https URL",
+			resolved: mustParse("https://example.com/addon.tgz"),
+			want:     RemoteTypeHTTP,
+		},
+		{
+			name:     "http URL",
+			resolved: mustParse("http://example.com/addon.tgz"),
+			want:     RemoteTypeHTTP,
+		},
+	}
+
+	for _, tt := range testCases {
+		r := &Remote{RemoteType: tt.remoteType}
+		if got := r.effectiveType(tt.resolved); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestBoardPlatform checks the FLATCAR_BOARD (and legacy COREOS_BOARD)
+// to GOOS/GOARCH mapping used to select a manifest out of a multi-platform
+// OCI image index.
+func TestBoardPlatform(t *testing.T) {
+	writeOsRelease := func(t *testing.T, content string) string {
+		t.Helper()
+		usrMountpoint := t.TempDir()
+		libDir := filepath.Join(usrMountpoint, "lib")
+		if err := os.MkdirAll(libDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(libDir, "os-release"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return usrMountpoint
+	}
+
+	testCases := []struct {
+		name     string
+		content  string
+		wantOS   string
+		wantArch string
+		wantErr  bool
+	}{
+		{
+			name:     "amd64-usr via FLATCAR_BOARD",
+			content:  `FLATCAR_BOARD="amd64-usr"`,
+			wantOS:   "linux",
+			wantArch: "amd64",
+		},
+		{
+			name:     "arm64-usr via FLATCAR_BOARD",
+			content:  `FLATCAR_BOARD="arm64-usr"`,
+			wantOS:   "linux",
+			wantArch: "arm64",
+		},
+		{
+			name:     "amd64-usr via legacy COREOS_BOARD",
+			content:  `COREOS_BOARD="amd64-usr"`,
+			wantOS:   "linux",
+			wantArch: "amd64",
+		},
+		{
+			name:    "unrecognized board",
+			content: `FLATCAR_BOARD="mips-usr"`,
+			wantErr: true,
+		},
+		{
+			name:    "no board at all",
+			content: `ID=flatcar`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range testCases {
+		usrMountpoint := writeOsRelease(t, tt.content)
+
+		platform, err := boardPlatform(usrMountpoint)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got none", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: got unexpected error %s", tt.name, err)
+			continue
+		}
+		if platform.OS != tt.wantOS || platform.Architecture != tt.wantArch {
+			t.Errorf("%s: got %s/%s, want %s/%s", tt.name, platform.OS, platform.Architecture, tt.wantOS, tt.wantArch)
+		}
+	}
+}
+
 func TestEvaluateURLTemplating(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "torcx_remote_test_")
 	if err != nil {
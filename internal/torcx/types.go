@@ -0,0 +1,61 @@
+// Copyright 2021 Kinvolk GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+// ArchiveFormat identifies how an addon archive is stored on disk, and thus
+// how applyImages should turn it into a usable rootfs.
+type ArchiveFormat string
+
+const (
+	// ArchiveFormatTgz is a gzip-compressed tarball, fully unpacked by
+	// unpackTgz.
+	ArchiveFormatTgz ArchiveFormat = "tgz"
+	// ArchiveFormatSquashfs is a squashfs image, mounted read-only by
+	// mountSquashfs.
+	ArchiveFormatSquashfs ArchiveFormat = "squashfs"
+	// ArchiveFormatEstargz is an eStargz-formatted layer, lazily mounted
+	// by mountEstargz instead of being fully unpacked.
+	ArchiveFormatEstargz ArchiveFormat = "estargz"
+)
+
+// Archive is a single fetched addon archive, ready to be unpacked or
+// mounted.
+type Archive struct {
+	// Format selects how Filepath should be turned into a rootfs.
+	Format ArchiveFormat
+	// Filepath is the archive's location on local disk.
+	Filepath string
+	// Digest is the resolved, digest-pinned reference this archive was
+	// fetched at (e.g. "registry.example.com/repo@sha256:..."), set for
+	// OCI-backed remotes so ApplyProfile can seal the next boot's
+	// RunProfile to the exact content that was applied. Empty for
+	// archives with no meaningful content digest.
+	Digest string
+}
+
+// Assets groups the classes of executable and configuration content that
+// applyImages propagates out of an unpacked image, as paths relative to
+// the image root.
+type Assets struct {
+	Binaries  []string
+	Network   []string
+	Units     []string
+	Sysusers  []string
+	Tmpfiles  []string
+	UdevRules []string
+	// CNI lists network plugin configs (under cni/) and binaries (under
+	// cni/bin/) shipped by the image.
+	CNI []string
+}
@@ -0,0 +1,308 @@
+// Copyright 2021 Kinvolk GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// oidFulcioIssuer is Fulcio's certificate extension OID carrying the OIDC
+// issuer that vouched for the signing identity
+// (https://github.com/sigstore/fulcio/blob/main/docs/oid-info.md). Unlike
+// cert.Issuer, which is always Fulcio's own CA identity and constant across
+// every certificate it issues, this extension is the only place the actual
+// identity provider is recorded.
+var oidFulcioIssuer = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+
+// KeylessPolicy verifies a Fulcio-issued signing certificate against a
+// configured root of trust, checks its identity claims against an allowed
+// list, and verifies that the signature is backed by a Rekor transparency
+// log inclusion proof.
+type KeylessPolicy struct {
+	// RootCertsPEM is a bundle of one or more CA certificates that the
+	// signing certificate must chain up to (typically Fulcio's root).
+	RootCertsPEM []byte
+	// RekorPublicKeyPEM is the Rekor transparency log's public key, used
+	// to verify the signed entry timestamp (SET) of the inclusion proof.
+	RekorPublicKeyPEM []byte
+	// AllowedIssuers restricts which OIDC issuers a signing identity may
+	// have been certified under. Empty means any issuer is accepted.
+	AllowedIssuers []string
+	// AllowedSANs restricts which subject alternative names (e.g. a CI
+	// workflow identity's email or URI) a signing certificate may carry.
+	// Empty means any SAN is accepted.
+	AllowedSANs []string
+}
+
+// rekorBundle is the sidecar "<archive>.rekor" file: the Rekor log entry
+// this signature was recorded under, plus the log's inclusion proof.
+type rekorBundle struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogIndex       int64  `json:"logIndex"`
+	LogID          string `json:"logID"`
+	// SET is the base64-encoded signed entry timestamp: Rekor's signature
+	// over the canonicalized fields above, proving log inclusion.
+	SET string `json:"signedEntryTimestamp"`
+}
+
+// verifyKeyless checks a Fulcio certificate, its identity claims, its Rekor
+// inclusion proof, and that the Rekor entry actually logs this archive's
+// digest/signature/certificate, then verifies digest/sig against the
+// certificate's public key.
+func verifyKeyless(archivePath string, digest []byte, sig []byte, policy KeylessPolicy) error {
+	cert, err := loadCert(archivePath + ".cert")
+	if err != nil {
+		return errors.Wrap(err, "loading signing certificate")
+	}
+
+	bundle, err := loadRekorBundle(archivePath + ".rekor")
+	if err != nil {
+		return errors.Wrap(err, "loading Rekor inclusion proof")
+	}
+
+	if err := verifyRekorSET(*bundle, policy.RekorPublicKeyPEM); err != nil {
+		return errors.Wrap(err, "verifying Rekor inclusion proof")
+	}
+
+	if err := verifyRekorEntryBinding(*bundle, cert, sig, digest); err != nil {
+		return errors.Wrap(err, "verifying Rekor entry matches archive")
+	}
+
+	// The signing certificate is only valid for the short window Fulcio
+	// issued it for, so check the chain at the moment Rekor says it was
+	// actually used to sign, not against the certificate's own window
+	// (which would make the check a tautology).
+	integratedTime := time.Unix(bundle.IntegratedTime, 0)
+	if err := verifyCertChain(cert, policy.RootCertsPEM, integratedTime); err != nil {
+		return errors.Wrap(err, "verifying certificate chain")
+	}
+
+	if err := verifyIdentity(cert, policy); err != nil {
+		return errors.Wrap(err, "verifying signer identity")
+	}
+
+	return verifyDigest(cert.PublicKey, digest, sig)
+}
+
+// loadCert reads and parses a single PEM-encoded certificate.
+func loadCert(path string) (*x509.Certificate, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// verifyCertChain checks that cert chains up to one of the CAs in
+// rootCertsPEM, and that it was valid at currentTime (the Rekor-attested
+// moment the certificate was used to sign, since short-lived Fulcio certs
+// are typically expired by the time an archive is verified).
+func verifyCertChain(cert *x509.Certificate, rootCertsPEM []byte, currentTime time.Time) error {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rootCertsPEM) {
+		return errors.New("no valid root certificates configured")
+	}
+
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:       roots,
+		CurrentTime: currentTime,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	return err
+}
+
+// verifyIdentity checks the certificate's OIDC issuer and SANs against
+// policy.
+func verifyIdentity(cert *x509.Certificate, policy KeylessPolicy) error {
+	if len(policy.AllowedIssuers) > 0 {
+		issuer, err := certOIDCIssuer(cert)
+		if err != nil {
+			return err
+		}
+		if !contains(policy.AllowedIssuers, issuer) {
+			return errors.Errorf("issuer %q is not in the allowed list", issuer)
+		}
+	}
+
+	if len(policy.AllowedSANs) > 0 {
+		var sans []string
+		sans = append(sans, cert.EmailAddresses...)
+		for _, u := range cert.URIs {
+			sans = append(sans, u.String())
+		}
+		matched := false
+		for _, san := range sans {
+			if contains(policy.AllowedSANs, san) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return errors.Errorf("none of the certificate SANs %v are in the allowed list", sans)
+		}
+	}
+
+	return nil
+}
+
+// certOIDCIssuer returns the OIDC issuer that vouched for cert's identity,
+// read from Fulcio's issuer extension rather than cert.Issuer (the signing
+// CA's own, constant identity). The extension's value is usually a
+// DER-encoded ASN.1 string, but older Fulcio releases wrote it as a raw
+// UTF-8 string, so an undecodable value is taken as-is.
+func certOIDCIssuer(cert *x509.Certificate) (string, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidFulcioIssuer) {
+			continue
+		}
+		var issuer string
+		if _, err := asn1.Unmarshal(ext.Value, &issuer); err == nil {
+			return issuer, nil
+		}
+		return string(ext.Value), nil
+	}
+	return "", errors.New("certificate has no Fulcio OIDC issuer extension")
+}
+
+// loadRekorBundle reads and parses a sidecar Rekor inclusion proof.
+func loadRekorBundle(path string) (*rekorBundle, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var bundle rekorBundle
+	if err := json.Unmarshal(raw, &bundle); err != nil {
+		return nil, errors.Wrap(err, "decoding Rekor bundle")
+	}
+	return &bundle, nil
+}
+
+// verifyRekorSET checks the signed entry timestamp over bundle's canonical
+// fields using the Rekor log's public key.
+func verifyRekorSET(bundle rekorBundle, rekorPublicKeyPEM []byte) error {
+	pub, err := parsePublicKey(string(rekorPublicKeyPEM))
+	if err != nil {
+		return errors.Wrap(err, "parsing Rekor public key")
+	}
+
+	set, err := base64.StdEncoding.DecodeString(bundle.SET)
+	if err != nil {
+		return errors.Wrap(err, "decoding signed entry timestamp")
+	}
+
+	payload, err := json.Marshal(struct {
+		Body           string `json:"body"`
+		IntegratedTime int64  `json:"integratedTime"`
+		LogIndex       int64  `json:"logIndex"`
+		LogID          string `json:"logID"`
+	}{bundle.Body, bundle.IntegratedTime, bundle.LogIndex, bundle.LogID})
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(payload)
+
+	return verifyDigest(pub, digest[:], set)
+}
+
+// hashedRekordEntry is the subset of Rekor's "hashedrekord" entry kind
+// (https://github.com/sigstore/rekor) that ties a logged entry to a
+// specific digest, signature, and signing certificate.
+type hashedRekordEntry struct {
+	Spec struct {
+		Signature struct {
+			Content   string `json:"content"`
+			PublicKey struct {
+				Content string `json:"content"`
+			} `json:"publicKey"`
+		} `json:"signature"`
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+	} `json:"spec"`
+}
+
+// verifyRekorEntryBinding decodes bundle's logged entry and checks that it
+// actually references this archive's digest, signature, and certificate,
+// rather than just being a validly-logged entry for an unrelated artifact.
+func verifyRekorEntryBinding(bundle rekorBundle, cert *x509.Certificate, sig []byte, digest []byte) error {
+	raw, err := base64.StdEncoding.DecodeString(bundle.Body)
+	if err != nil {
+		return errors.Wrap(err, "decoding Rekor entry body")
+	}
+
+	var entry hashedRekordEntry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return errors.Wrap(err, "decoding Rekor entry")
+	}
+
+	if !strings.EqualFold(entry.Spec.Data.Hash.Algorithm, "sha256") {
+		return errors.Errorf("unexpected digest algorithm %q in Rekor entry", entry.Spec.Data.Hash.Algorithm)
+	}
+	if entry.Spec.Data.Hash.Value != hex.EncodeToString(digest) {
+		return errors.New("Rekor entry digest does not match archive")
+	}
+
+	loggedSig, err := base64.StdEncoding.DecodeString(entry.Spec.Signature.Content)
+	if err != nil {
+		return errors.Wrap(err, "decoding Rekor entry signature")
+	}
+	if !bytes.Equal(loggedSig, sig) {
+		return errors.New("Rekor entry signature does not match archive signature")
+	}
+
+	loggedCertPEM, err := base64.StdEncoding.DecodeString(entry.Spec.Signature.PublicKey.Content)
+	if err != nil {
+		return errors.Wrap(err, "decoding Rekor entry certificate")
+	}
+	block, _ := pem.Decode(loggedCertPEM)
+	if block == nil {
+		return errors.New("failed to decode Rekor entry certificate PEM")
+	}
+	if !bytes.Equal(block.Bytes, cert.Raw) {
+		return errors.New("Rekor entry certificate does not match signing certificate")
+	}
+
+	return nil
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 Kinvolk GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package verify checks detached signatures over torcx archives before they
+// are unpacked, in either of two modes: classic verification against a
+// fixed set of public keys, or keyless verification against a Fulcio
+// certificate chain backed by a Rekor transparency log entry.
+package verify
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Policy describes how a single archive's signature should be checked.
+// Exactly one of PublicKeys or Keyless should be set.
+type Policy struct {
+	// PublicKeys are PEM-encoded ed25519 or ECDSA public keys. An archive
+	// verifies if its signature matches any one of them.
+	PublicKeys []string
+	// Keyless, if set, verifies the archive against a Fulcio-issued
+	// certificate and a Rekor transparency-log inclusion proof instead of
+	// a fixed public key.
+	Keyless *KeylessPolicy
+}
+
+// Empty reports whether this policy configures no verification at all.
+func (p Policy) Empty() bool {
+	return len(p.PublicKeys) == 0 && p.Keyless == nil
+}
+
+// Archive checks the detached signature for archivePath according to
+// policy. Sidecar files are expected alongside the archive:
+//   - "<archivePath>.sig" always, a base64-encoded signature over the
+//     sha256 digest of the archive;
+//   - "<archivePath>.cert", the signing certificate, for Keyless policies;
+//   - "<archivePath>.rekor", the Rekor inclusion proof, for Keyless policies.
+func Archive(archivePath string, policy Policy) error {
+	if policy.Empty() {
+		return errors.New("empty verification policy")
+	}
+
+	digest, err := sha256Digest(archivePath)
+	if err != nil {
+		return errors.Wrapf(err, "digesting %q", archivePath)
+	}
+
+	sig, err := readSidecarSignature(archivePath + ".sig")
+	if err != nil {
+		return errors.Wrapf(err, "reading signature for %q", archivePath)
+	}
+
+	if policy.Keyless != nil {
+		return verifyKeyless(archivePath, digest, sig, *policy.Keyless)
+	}
+
+	return verifyKeyed(digest, sig, policy.PublicKeys)
+}
+
+// verifyKeyed checks digest against sig using the first of pemKeys whose
+// signature matches.
+func verifyKeyed(digest []byte, sig []byte, pemKeys []string) error {
+	var lastErr error
+	for _, pemKey := range pemKeys {
+		pub, err := parsePublicKey(pemKey)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := verifyDigest(pub, digest, sig); err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no public keys configured")
+	}
+	return errors.Wrap(lastErr, "signature does not match any configured public key")
+}
+
+// verifyDigest checks that sig is a valid signature of digest under pub,
+// dispatching on the concrete key type.
+func verifyDigest(pub crypto.PublicKey, digest []byte, sig []byte) error {
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, digest, sig) {
+			return errors.New("ed25519 signature verification failed")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest, sig) {
+			return errors.New("ECDSA signature verification failed")
+		}
+		return nil
+	default:
+		return errors.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// parsePublicKey decodes a PEM-encoded ed25519 or ECDSA public key.
+func parsePublicKey(pemKey string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing public key")
+	}
+	return pub, nil
+}
+
+// sha256Digest returns the sha256 digest of the file at path.
+func sha256Digest(path string) ([]byte, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fp); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// readSidecarSignature reads and base64-decodes a detached signature file.
+func readSidecarSignature(path string) ([]byte, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(string(raw))
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding base64 signature")
+	}
+	return sig, nil
+}
@@ -0,0 +1,401 @@
+// Copyright 2021 Kinvolk GmbH
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verify
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeArchiveAndSig(t *testing.T, sign func(digest []byte) []byte) string {
+	t.Helper()
+
+	tmpDir, err := ioutil.TempDir("", "torcx_verify_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	archivePath := filepath.Join(tmpDir, "addon.tgz")
+	if err := ioutil.WriteFile(archivePath, []byte("fake archive content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := sha256Digest(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig := sign(digest)
+	encoded := base64.StdEncoding.EncodeToString(sig)
+	if err := ioutil.WriteFile(archivePath+".sig", []byte(encoded), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return archivePath
+}
+
+func pemEncodePublicKey(t *testing.T, pub interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestArchiveEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archivePath := writeArchiveAndSig(t, func(digest []byte) []byte {
+		return ed25519.Sign(priv, digest)
+	})
+
+	policy := Policy{PublicKeys: []string{pemEncodePublicKey(t, pub)}}
+	if err := Archive(archivePath, policy); err != nil {
+		t.Fatalf("expected successful verification, got %s", err)
+	}
+}
+
+func TestArchiveECDSA(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archivePath := writeArchiveAndSig(t, func(digest []byte) []byte {
+		sig, err := ecdsa.SignASN1(rand.Reader, priv, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	})
+
+	policy := Policy{PublicKeys: []string{pemEncodePublicKey(t, &priv.PublicKey)}}
+	if err := Archive(archivePath, policy); err != nil {
+		t.Fatalf("expected successful verification, got %s", err)
+	}
+}
+
+func TestArchiveWrongKeyFails(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archivePath := writeArchiveAndSig(t, func(digest []byte) []byte {
+		return ed25519.Sign(priv, digest)
+	})
+
+	policy := Policy{PublicKeys: []string{pemEncodePublicKey(t, otherPub)}}
+	if err := Archive(archivePath, policy); err == nil {
+		t.Fatal("expected verification to fail with a mismatched key")
+	}
+}
+
+func TestArchiveEmptyPolicy(t *testing.T) {
+	if err := Archive("/nonexistent", Policy{}); err == nil {
+		t.Fatal("expected an error for an empty policy")
+	}
+}
+
+// keylessFixtureOpts configures a synthetic keyless signing fixture, so
+// individual tests can tweak exactly the one thing they want to break.
+type keylessFixtureOpts struct {
+	leafNotBefore  time.Time
+	leafNotAfter   time.Time
+	integratedTime time.Time
+	// boundDigestHex, if set, overrides the digest recorded in the Rekor
+	// entry, simulating a validly-logged entry for an unrelated artifact.
+	boundDigestHex string
+	// oidcIssuer, if set, is embedded in the leaf certificate's Fulcio
+	// issuer extension; if empty, the extension is omitted entirely.
+	oidcIssuer     string
+	allowedIssuers []string
+	allowedSANs    []string
+}
+
+// newKeylessFixture writes a signed archive plus its ".cert"/".sig"/".rekor"
+// sidecars under a temp dir, and returns the archive path and the
+// KeylessPolicy that should verify it (absent the opts-requested break).
+func newKeylessFixture(t *testing.T, opts keylessFixtureOpts) (string, KeylessPolicy) {
+	t.Helper()
+
+	tmpDir, err := ioutil.TempDir("", "torcx_verify_keyless_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	archivePath := filepath.Join(tmpDir, "addon.tgz")
+	if err := ioutil.WriteFile(archivePath, []byte("fake keyless archive content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := sha256Digest(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-fulcio-root"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCert, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootDER})
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: "leaf"},
+		NotBefore:      opts.leafNotBefore,
+		NotAfter:       opts.leafNotAfter,
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses: []string{"ci@example.com"},
+	}
+	if opts.oidcIssuer != "" {
+		issuerValue, err := asn1.Marshal(opts.oidcIssuer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leafTemplate.ExtraExtensions = []pkix.Extension{
+			{Id: oidFulcioIssuer, Value: issuerValue},
+		}
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, rootCert, &leafKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+
+	sig, err := ecdsa.SignASN1(rand.Reader, leafKey, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(archivePath+".sig", []byte(base64.StdEncoding.EncodeToString(sig)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(archivePath+".cert", leafPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rekorPub, rekorPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashValue := hex.EncodeToString(digest)
+	if opts.boundDigestHex != "" {
+		hashValue = opts.boundDigestHex
+	}
+
+	var entry hashedRekordEntry
+	entry.Spec.Signature.Content = base64.StdEncoding.EncodeToString(sig)
+	entry.Spec.Signature.PublicKey.Content = base64.StdEncoding.EncodeToString(leafPEM)
+	entry.Spec.Data.Hash.Algorithm = "sha256"
+	entry.Spec.Data.Hash.Value = hashValue
+
+	bodyJSON, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := rekorBundle{
+		Body:           base64.StdEncoding.EncodeToString(bodyJSON),
+		IntegratedTime: opts.integratedTime.Unix(),
+		LogIndex:       1,
+		LogID:          "test-log",
+	}
+
+	payload, err := json.Marshal(struct {
+		Body           string `json:"body"`
+		IntegratedTime int64  `json:"integratedTime"`
+		LogIndex       int64  `json:"logIndex"`
+		LogID          string `json:"logID"`
+	}{bundle.Body, bundle.IntegratedTime, bundle.LogIndex, bundle.LogID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setDigest := sha256.Sum256(payload)
+	bundle.SET = base64.StdEncoding.EncodeToString(ed25519.Sign(rekorPriv, setDigest[:]))
+
+	bundleJSON, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(archivePath+".rekor", bundleJSON, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := KeylessPolicy{
+		RootCertsPEM:      rootPEM,
+		RekorPublicKeyPEM: []byte(pemEncodePublicKey(t, rekorPub)),
+		AllowedIssuers:    opts.allowedIssuers,
+		AllowedSANs:       opts.allowedSANs,
+	}
+	return archivePath, policy
+}
+
+func TestArchiveKeylessValid(t *testing.T) {
+	now := time.Now()
+	archivePath, policy := newKeylessFixture(t, keylessFixtureOpts{
+		leafNotBefore:  now.Add(-5 * time.Minute),
+		leafNotAfter:   now.Add(5 * time.Minute),
+		integratedTime: now,
+		oidcIssuer:     "https://accounts.example.com",
+		allowedIssuers: []string{"https://accounts.example.com"},
+		allowedSANs:    []string{"ci@example.com"},
+	})
+
+	if err := Archive(archivePath, Policy{Keyless: &policy}); err != nil {
+		t.Fatalf("expected successful verification, got %s", err)
+	}
+}
+
+// TestArchiveKeylessBoundDigestMismatchFails simulates replaying a
+// validly-logged Rekor bundle for an unrelated artifact next to this
+// archive's own cert and signature: without checking that the entry itself
+// references this archive's digest, the old code would have accepted it.
+func TestArchiveKeylessBoundDigestMismatchFails(t *testing.T) {
+	now := time.Now()
+	archivePath, policy := newKeylessFixture(t, keylessFixtureOpts{
+		leafNotBefore:  now.Add(-5 * time.Minute),
+		leafNotAfter:   now.Add(5 * time.Minute),
+		integratedTime: now,
+		boundDigestHex: strings.Repeat("ab", sha256.Size),
+		oidcIssuer:     "https://accounts.example.com",
+		allowedIssuers: []string{"https://accounts.example.com"},
+		allowedSANs:    []string{"ci@example.com"},
+	})
+
+	if err := Archive(archivePath, Policy{Keyless: &policy}); err == nil {
+		t.Fatal("expected verification to fail when the Rekor entry is not bound to this archive's digest")
+	}
+}
+
+// TestArchiveKeylessExpiredCertFails checks a certificate that had already
+// expired at the Rekor-attested integration time of its signature: checking
+// the chain against the certificate's own NotBefore (instead of the
+// Rekor-attested integration time) would make this a tautology that never
+// rejects anything.
+func TestArchiveKeylessExpiredCertFails(t *testing.T) {
+	now := time.Now()
+	archivePath, policy := newKeylessFixture(t, keylessFixtureOpts{
+		leafNotBefore:  now.Add(-2 * time.Hour),
+		leafNotAfter:   now.Add(-1 * time.Hour),
+		integratedTime: now,
+		oidcIssuer:     "https://accounts.example.com",
+		allowedIssuers: []string{"https://accounts.example.com"},
+		allowedSANs:    []string{"ci@example.com"},
+	})
+
+	if err := Archive(archivePath, Policy{Keyless: &policy}); err == nil {
+		t.Fatal("expected verification to fail for a certificate expired at the Rekor integration time")
+	}
+}
+
+func TestArchiveKeylessDisallowedIssuerFails(t *testing.T) {
+	now := time.Now()
+	archivePath, policy := newKeylessFixture(t, keylessFixtureOpts{
+		leafNotBefore:  now.Add(-5 * time.Minute),
+		leafNotAfter:   now.Add(5 * time.Minute),
+		integratedTime: now,
+		oidcIssuer:     "https://accounts.example.com",
+		allowedIssuers: []string{"some-other-issuer"},
+		allowedSANs:    []string{"ci@example.com"},
+	})
+
+	if err := Archive(archivePath, Policy{Keyless: &policy}); err == nil {
+		t.Fatal("expected verification to fail for a disallowed issuer")
+	}
+}
+
+func TestArchiveKeylessDisallowedSANFails(t *testing.T) {
+	now := time.Now()
+	archivePath, policy := newKeylessFixture(t, keylessFixtureOpts{
+		leafNotBefore:  now.Add(-5 * time.Minute),
+		leafNotAfter:   now.Add(5 * time.Minute),
+		integratedTime: now,
+		oidcIssuer:     "https://accounts.example.com",
+		allowedIssuers: []string{"https://accounts.example.com"},
+		allowedSANs:    []string{"nobody@example.com"},
+	})
+
+	if err := Archive(archivePath, Policy{Keyless: &policy}); err == nil {
+		t.Fatal("expected verification to fail for a disallowed SAN")
+	}
+}
+
+// TestArchiveKeylessMissingIssuerExtensionFails checks a certificate with no
+// Fulcio issuer extension at all against a non-empty AllowedIssuers: the old
+// code would have fallen back to the certificate's own (constant) Issuer
+// field and accepted it regardless of who actually signed in.
+func TestArchiveKeylessMissingIssuerExtensionFails(t *testing.T) {
+	now := time.Now()
+	archivePath, policy := newKeylessFixture(t, keylessFixtureOpts{
+		leafNotBefore:  now.Add(-5 * time.Minute),
+		leafNotAfter:   now.Add(5 * time.Minute),
+		integratedTime: now,
+		allowedIssuers: []string{"https://accounts.example.com"},
+		allowedSANs:    []string{"ci@example.com"},
+	})
+
+	if err := Archive(archivePath, Policy{Keyless: &policy}); err == nil {
+		t.Fatal("expected verification to fail when the certificate has no Fulcio issuer extension")
+	}
+}